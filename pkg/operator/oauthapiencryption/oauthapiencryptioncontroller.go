@@ -0,0 +1,336 @@
+package oauthapiencryption
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	multierror "github.com/hashicorp/go-multierror"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1informers "k8s.io/client-go/informers/core/v1"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+
+	operatorv1 "github.com/openshift/api/operator/v1"
+	operatorv1informers "github.com/openshift/client-go/operator/informers/externalversions/operator/v1"
+	operatorv1listers "github.com/openshift/client-go/operator/listers/operator/v1"
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/encryption/encryptionconfig"
+	encryptionsecret "github.com/openshift/library-go/pkg/operator/encryption/secrets"
+	encryptionstate "github.com/openshift/library-go/pkg/operator/encryption/state"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/openshift/library-go/pkg/operator/v1helpers"
+
+	"github.com/openshift/cluster-openshift-apiserver-operator/pkg/operator/operatorclient"
+)
+
+const (
+	// EncryptionConfigManagedBy marks a mirrored encryption-config secret as owned by this
+	// controller, so it isn't mistaken for a secret rendered by someone else (e.g. the
+	// cluster-authentication-operator once it takes over).
+	EncryptionConfigManagedBy = "encryption.apiserver.operator.openshift.io/managed-by"
+
+	// sourceHashAnnotation records the SHA-256 of the source secret's encryption-config bytes we
+	// last reconciled, so we can tell whether a mirror is already current without comparing (and
+	// potentially clobbering) the rest of the object.
+	sourceHashAnnotation = "encryption.apiserver.operator.openshift.io/source-hash"
+
+	encryptionConfigManagedByValue = "openshift-apiserver-operator"
+
+	// managingOAuthAPIServerCondition is set on the authentication operator's status once the
+	// cluster-authentication-operator has taken over rendering the OAuth API server's own
+	// encryption-config secret.
+	managingOAuthAPIServerCondition = "ManagingOAuthAPIServer"
+
+	// handedOffToCAOCondition is surfaced on our own operator status once we've stopped mirroring
+	// the secret because the cluster-authentication-operator owns it now.
+	handedOffToCAOCondition = "HandedOffToCAO"
+
+	authOperatorName = "cluster"
+
+	// maxUpdateConflictRetries bounds how many times we'll re-fetch and retry an update that lost
+	// a write race with another writer of the same secret (e.g. CAO, or a human editing it).
+	maxUpdateConflictRetries = 5
+)
+
+// MirrorTarget describes one encryption-config secret this controller keeps mirrored from the
+// openshift-apiserver's own encryption-config.
+type MirrorTarget struct {
+	// Name labels this target in logs and event reasons, e.g. "oauth-apiserver".
+	Name string
+	// SourceSecretName is the encryption-config secret, in
+	// operatorclient.GlobalMachineSpecifiedConfigNamespace, to mirror from.
+	SourceSecretName string
+	// DestSecretName is the name of the mirrored secret.
+	DestSecretName string
+	// DestNamespace is the namespace the mirrored secret lives in.
+	DestNamespace string
+	// ManagedByValue is written to the EncryptionConfigManagedBy annotation of the mirrored secret,
+	// so this target's mirror can be told apart from one mirrored by a different controller.
+	ManagedByValue string
+	// YieldsToCAO marks this target as one the cluster-authentication-operator may take over
+	// rendering itself. Only targets with this set are affected by ManagingOAuthAPIServer; it has
+	// no bearing on any other target, since CAO only ever takes over the OAuth API server's secret.
+	YieldsToCAO bool
+}
+
+// OAuthAPIServerMirrorTarget is the MirrorTarget that mirrors the openshift-apiserver's
+// encryption-config into the secret the (in-process) oauth-apiserver reads.
+func OAuthAPIServerMirrorTarget() MirrorTarget {
+	return MirrorTarget{
+		Name:             "oauth-apiserver",
+		SourceSecretName: fmt.Sprintf("%s-openshift-apiserver", encryptionconfig.EncryptionConfSecretName),
+		DestSecretName:   fmt.Sprintf("%s-oauth-apiserver", encryptionconfig.EncryptionConfSecretName),
+		DestNamespace:    operatorclient.GlobalMachineSpecifiedConfigNamespace,
+		ManagedByValue:   encryptionConfigManagedByValue,
+		YieldsToCAO:      true,
+	}
+}
+
+// oauthEncryptionConfigSyncController mirrors the openshift-apiserver's encryption-config secret
+// into one secret per configured MirrorTarget, for as long as the cluster-authentication-operator
+// hasn't taken over that responsibility for us. Once CAO sets ManagingOAuthAPIServer=true on its
+// operator status, we yield on every target with YieldsToCAO set: we stop rewriting those secrets
+// and relinquish our claim on them so the two operators never fight over their content. Targets
+// that don't set YieldsToCAO are unaffected, since CAO only ever takes over the OAuth API server.
+type oauthEncryptionConfigSyncController struct {
+	targets []MirrorTarget
+
+	operatorClient     v1helpers.OperatorClient
+	authOperatorLister operatorv1listers.AuthenticationLister
+
+	secretLister corev1listers.SecretLister
+	secretClient corev1client.SecretsGetter
+}
+
+// NewOAuthEncryptionConfigSyncController returns a controller that mirrors the
+// openshift-apiserver's encryption-config secret into every given target, yielding to the
+// cluster-authentication-operator once it announces it is managing the OAuth API server.
+func NewOAuthEncryptionConfigSyncController(
+	targets []MirrorTarget,
+	operatorClient v1helpers.OperatorClient,
+	authOperatorInformer operatorv1informers.AuthenticationInformer,
+	secretInformer corev1informers.SecretInformer,
+	secretClient corev1client.SecretsGetter,
+	recorder events.Recorder,
+) factory.Controller {
+	c := &oauthEncryptionConfigSyncController{
+		targets:            targets,
+		operatorClient:     operatorClient,
+		authOperatorLister: authOperatorInformer.Lister(),
+		secretLister:       secretInformer.Lister(),
+		secretClient:       secretClient,
+	}
+
+	return factory.New().
+		WithSync(c.sync).
+		WithInformers(secretInformer.Informer(), authOperatorInformer.Informer(), operatorClient.Informer()).
+		ToController("OAuthEncryptionConfigSyncController", recorder)
+}
+
+func (c *oauthEncryptionConfigSyncController) sync(ctx context.Context, syncCtx factory.SyncContext) error {
+	managingOAuthAPIServer, err := c.isCAOManagingOAuthAPIServer()
+	if err != nil {
+		return err
+	}
+
+	var errs *multierror.Error
+	for _, target := range c.targets {
+		if err := c.syncTarget(ctx, syncCtx, target, managingOAuthAPIServer); err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("mirroring %q to %s/%s: %w", target.Name, target.DestNamespace, target.DestSecretName, err))
+		}
+	}
+	return errs.ErrorOrNil()
+}
+
+func (c *oauthEncryptionConfigSyncController) syncTarget(ctx context.Context, syncCtx factory.SyncContext, target MirrorTarget, managingOAuthAPIServer bool) error {
+	sourceSecret, err := c.secretLister.Secrets(operatorclient.GlobalMachineSpecifiedConfigNamespace).Get(target.SourceSecretName)
+	if apierrors.IsNotFound(err) {
+		// encryption is off, there is nothing for us to mirror
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if target.YieldsToCAO && managingOAuthAPIServer {
+		return c.yieldToCAO(ctx, syncCtx, target)
+	}
+
+	return c.reconcileMirror(ctx, syncCtx, target, sourceSecret)
+}
+
+// reconcileMirror creates or updates the mirrored secret so that its encryption-config matches
+// source. It short-circuits when the source hash matches and our ownership markers (managed-by
+// annotation and finalizer) are still in place, so that third-party edits to fields we don't own
+// never trigger a spurious write, and survives races with other writers of the destination secret.
+func (c *oauthEncryptionConfigSyncController) reconcileMirror(ctx context.Context, syncCtx factory.SyncContext, target MirrorTarget, source *corev1.Secret) error {
+	sourceHash := computeSourceHash(source)
+
+	existing, err := c.secretLister.Secrets(target.DestNamespace).Get(target.DestSecretName)
+	if apierrors.IsNotFound(err) {
+		desired := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      target.DestSecretName,
+				Namespace: target.DestNamespace,
+			},
+		}
+		applyMirrorSecret(desired, source, target.ManagedByValue, sourceHash)
+
+		_, err := c.secretClient.Secrets(target.DestNamespace).Create(ctx, desired, metav1.CreateOptions{})
+		if apierrors.IsAlreadyExists(err) {
+			// someone raced us to create it, fall through to the update path
+			created, getErr := c.secretClient.Secrets(target.DestNamespace).Get(ctx, target.DestSecretName, metav1.GetOptions{})
+			if getErr != nil {
+				return getErr
+			}
+			return c.updateMirror(ctx, syncCtx, target, created, source, sourceHash)
+		}
+		if err != nil {
+			return err
+		}
+		syncCtx.Recorder().Eventf(fmt.Sprintf("SecretCreated:%s", target.Name), "Created secret %s/%s", target.DestNamespace, target.DestSecretName)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if existing.Annotations[sourceHashAnnotation] == sourceHash &&
+		existing.Annotations[EncryptionConfigManagedBy] == target.ManagedByValue &&
+		hasFinalizer(existing, encryptionsecret.EncryptionSecretFinalizer) {
+		return nil
+	}
+
+	return c.updateMirror(ctx, syncCtx, target, existing, source, sourceHash)
+}
+
+// updateMirror applies the desired mutation on top of existing, retrying on a resourceVersion
+// conflict by re-fetching the object via the lister and re-applying the mutation.
+func (c *oauthEncryptionConfigSyncController) updateMirror(ctx context.Context, syncCtx factory.SyncContext, target MirrorTarget, existing *corev1.Secret, source *corev1.Secret, sourceHash string) error {
+	current := existing
+	for attempt := 0; attempt < maxUpdateConflictRetries; attempt++ {
+		desired := current.DeepCopy()
+		applyMirrorSecret(desired, source, target.ManagedByValue, sourceHash)
+
+		_, err := c.secretClient.Secrets(target.DestNamespace).Update(ctx, desired, metav1.UpdateOptions{})
+		if err == nil {
+			syncCtx.Recorder().Eventf(fmt.Sprintf("SecretUpdated:%s", target.Name), "Updated secret %s/%s", target.DestNamespace, target.DestSecretName)
+			return nil
+		}
+		if !apierrors.IsConflict(err) {
+			return err
+		}
+
+		refetched, err := c.secretLister.Secrets(target.DestNamespace).Get(existing.Name)
+		if err != nil {
+			return err
+		}
+		current = refetched
+	}
+
+	return fmt.Errorf("failed to update secret %s/%s after %d conflict retries", target.DestNamespace, existing.Name, maxUpdateConflictRetries)
+}
+
+// isCAOManagingOAuthAPIServer reports whether the cluster-authentication-operator has taken over
+// rendering the OAuth API server's encryption config.
+func (c *oauthEncryptionConfigSyncController) isCAOManagingOAuthAPIServer() (bool, error) {
+	authOperator, err := c.authOperatorLister.Get(authOperatorName)
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	condition := v1helpers.FindOperatorCondition(authOperator.Status.Conditions, managingOAuthAPIServerCondition)
+	return condition != nil && condition.Status == operatorv1.ConditionTrue, nil
+}
+
+// yieldToCAO relinquishes our claim on the mirrored secret: we drop the annotation and finalizer
+// we use to own it, so the cluster-authentication-operator can take over without us fighting it
+// over the secret's content on every resync.
+func (c *oauthEncryptionConfigSyncController) yieldToCAO(ctx context.Context, syncCtx factory.SyncContext, target MirrorTarget) error {
+	existing, err := c.secretLister.Secrets(target.DestNamespace).Get(target.DestSecretName)
+	if apierrors.IsNotFound(err) {
+		return c.reportHandedOff(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	if _, managedByUs := existing.Annotations[EncryptionConfigManagedBy]; !managedByUs && !hasFinalizer(existing, encryptionsecret.EncryptionSecretFinalizer) {
+		return c.reportHandedOff(ctx)
+	}
+
+	updated := existing.DeepCopy()
+	delete(updated.Annotations, EncryptionConfigManagedBy)
+	delete(updated.Annotations, sourceHashAnnotation)
+	updated.Finalizers = removeFinalizer(updated.Finalizers, encryptionsecret.EncryptionSecretFinalizer)
+
+	if _, err := c.secretClient.Secrets(target.DestNamespace).Update(ctx, updated, metav1.UpdateOptions{}); err != nil {
+		return err
+	}
+	syncCtx.Recorder().Eventf(fmt.Sprintf("SecretHandedOffToCAO:%s", target.Name), "Stopped managing secret %s/%s, the cluster-authentication-operator is now in control", target.DestNamespace, target.DestSecretName)
+
+	return c.reportHandedOff(ctx)
+}
+
+func (c *oauthEncryptionConfigSyncController) reportHandedOff(ctx context.Context) error {
+	_, _, err := v1helpers.UpdateStatus(ctx, c.operatorClient, v1helpers.UpdateConditionFn(operatorv1.OperatorCondition{
+		Type:    handedOffToCAOCondition,
+		Status:  operatorv1.ConditionTrue,
+		Reason:  "CAOManagingOAuthAPIServer",
+		Message: "the cluster-authentication-operator is managing the OAuth API server's encryption config",
+	}))
+	return err
+}
+
+// applyMirrorSecret reconciles only the fields we own (our annotations, our finalizer and the
+// encryption-config data) onto secret, leaving any annotations/labels a third party may have added
+// untouched.
+func applyMirrorSecret(secret *corev1.Secret, source *corev1.Secret, managedByValue string, sourceHash string) {
+	if secret.Annotations == nil {
+		secret.Annotations = map[string]string{}
+	}
+	secret.Annotations[EncryptionConfigManagedBy] = managedByValue
+	secret.Annotations[encryptionstate.KubernetesDescriptionKey] = encryptionstate.KubernetesDescriptionScaryValue
+	secret.Annotations[sourceHashAnnotation] = sourceHash
+
+	if !hasFinalizer(secret, encryptionsecret.EncryptionSecretFinalizer) {
+		secret.Finalizers = append(secret.Finalizers, encryptionsecret.EncryptionSecretFinalizer)
+	}
+
+	data := make(map[string][]byte, len(source.Data))
+	for k, v := range source.Data {
+		data[k] = append([]byte(nil), v...)
+	}
+	secret.Data = data
+}
+
+// computeSourceHash returns the hex-encoded SHA-256 of the source secret's encryption-config bytes.
+func computeSourceHash(source *corev1.Secret) string {
+	sum := sha256.Sum256(source.Data["encryption-config"])
+	return hex.EncodeToString(sum[:])
+}
+
+func hasFinalizer(secret *corev1.Secret, finalizer string) bool {
+	for _, f := range secret.Finalizers {
+		if f == finalizer {
+			return true
+		}
+	}
+	return false
+}
+
+func removeFinalizer(finalizers []string, finalizer string) []string {
+	out := make([]string, 0, len(finalizers))
+	for _, f := range finalizers {
+		if f != finalizer {
+			out = append(out, f)
+		}
+	}
+	return out
+}
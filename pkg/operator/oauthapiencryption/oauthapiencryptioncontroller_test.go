@@ -3,41 +3,66 @@ package oauthapiencryption
 import (
 	"context"
 	"fmt"
+	"strings"
 	"testing"
 
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/util/diff"
 	"k8s.io/client-go/kubernetes/fake"
 	corev1listers "k8s.io/client-go/listers/core/v1"
 	clientgotesting "k8s.io/client-go/testing"
 	"k8s.io/client-go/tools/cache"
 
+	operatorv1 "github.com/openshift/api/operator/v1"
+	operatorv1listers "github.com/openshift/client-go/operator/listers/operator/v1"
 	"github.com/openshift/cluster-openshift-apiserver-operator/pkg/operator/operatorclient"
 	"github.com/openshift/library-go/pkg/controller/factory"
 	"github.com/openshift/library-go/pkg/operator/encryption/encryptionconfig"
 	encryptionsecret "github.com/openshift/library-go/pkg/operator/encryption/secrets"
 	encryptionstate "github.com/openshift/library-go/pkg/operator/encryption/state"
 	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/openshift/library-go/pkg/operator/v1helpers"
 )
 
+// secondMirrorTarget is a synthetic second target used to exercise the multi-target matrix: an
+// aggregated API server other than oauth-apiserver whose encryption-config we also mirror.
+func secondMirrorTarget() MirrorTarget {
+	return MirrorTarget{
+		Name:             "second-apiserver",
+		SourceSecretName: fmt.Sprintf("%s-second-apiserver", encryptionconfig.EncryptionConfSecretName),
+		DestSecretName:   fmt.Sprintf("%s-second-apiserver-mirror", encryptionconfig.EncryptionConfSecretName),
+		DestNamespace:    operatorclient.GlobalMachineSpecifiedConfigNamespace,
+		ManagedByValue:   "second-apiserver-operator",
+	}
+}
+
 func TestOAuthAPIServerController(t *testing.T) {
 	scenarios := []struct {
-		name           string
-		initialSecrets []*corev1.Secret
-		validateFunc   func(ts *testing.T, actions []clientgotesting.Action)
+		name                  string
+		targets               []MirrorTarget
+		initialSecrets        []*corev1.Secret
+		apiServerOnlySecrets  []*corev1.Secret
+		authOperator          *operatorv1.Authentication
+		conflictOnFirstUpdate bool
+		failCreateForSecret   string
+		validateFunc          func(ts *testing.T, actions []clientgotesting.Action)
+		validateOperator      func(ts *testing.T, status *operatorv1.OperatorStatus)
 
 		expectedActions []string
 		expectedEvents  []string
+		expectError     string
 	}{
 		{
 			name:            "test case 1 - the secret doesn't exist and encryption is on",
 			initialSecrets:  []*corev1.Secret{defaultSecret(fmt.Sprintf("%s-openshift-apiserver", encryptionconfig.EncryptionConfSecretName))},
 			expectedActions: []string{"create:secrets:openshift-config-managed:encryption-config-oauth-apiserver"},
-			expectedEvents:  []string{"SecretCreated"},
+			expectedEvents:  []string{"SecretCreated:oauth-apiserver"},
 			validateFunc: func(ts *testing.T, actions []clientgotesting.Action) {
 				wasSecretValidated := false
 				for _, action := range actions {
@@ -85,7 +110,7 @@ func TestOAuthAPIServerController(t *testing.T) {
 				}(),
 			},
 			expectedActions: []string{"update:secrets:openshift-config-managed:encryption-config-oauth-apiserver"},
-			expectedEvents:  []string{"SecretUpdated"},
+			expectedEvents:  []string{"SecretUpdated:oauth-apiserver"},
 			validateFunc: func(ts *testing.T, actions []clientgotesting.Action) {
 				wasSecretValidated := false
 				for _, action := range actions {
@@ -95,6 +120,7 @@ func TestOAuthAPIServerController(t *testing.T) {
 
 						expectedSecret := defaultSecret(fmt.Sprintf("%s-oauth-apiserver", encryptionconfig.EncryptionConfSecretName))
 						expectedSecret.Data["encryption-config"] = []byte{0xAA}
+						expectedSecret.Annotations[sourceHashAnnotation] = computeSourceHash(expectedSecret)
 
 						if !equality.Semantic.DeepEqual(actualSecret, expectedSecret) {
 							ts.Errorf(diff.ObjectDiff(actualSecret, expectedSecret))
@@ -118,6 +144,281 @@ func TestOAuthAPIServerController(t *testing.T) {
 		{
 			name: "test case 4 - no-op encryption off",
 		},
+		{
+			name: "test case 5 - yields to CAO once it starts managing the OAuth API server",
+			initialSecrets: []*corev1.Secret{
+				defaultSecret(fmt.Sprintf("%s-openshift-apiserver", encryptionconfig.EncryptionConfSecretName)),
+				func() *corev1.Secret {
+					s := defaultSecret(fmt.Sprintf("%s-oauth-apiserver", encryptionconfig.EncryptionConfSecretName))
+					s.Annotations["encryption.apiserver.operator.openshift.io/managed-by"] = encryptionConfigManagedByValue
+					return s
+				}(),
+			},
+			authOperator:    managingOAuthAPIServerAuthOperator(),
+			expectedActions: []string{"update:secrets:openshift-config-managed:encryption-config-oauth-apiserver"},
+			expectedEvents:  []string{"SecretHandedOffToCAO:oauth-apiserver"},
+			validateFunc: func(ts *testing.T, actions []clientgotesting.Action) {
+				for _, action := range actions {
+					if !action.Matches("update", "secrets") {
+						continue
+					}
+					updateAction := action.(clientgotesting.UpdateAction)
+					actualSecret := updateAction.GetObject().(*corev1.Secret)
+					if _, ok := actualSecret.Annotations[EncryptionConfigManagedBy]; ok {
+						ts.Errorf("expected the %s annotation to be removed once CAO takes over", EncryptionConfigManagedBy)
+					}
+					if hasFinalizer(actualSecret, encryptionsecret.EncryptionSecretFinalizer) {
+						ts.Errorf("expected our finalizer to be removed once CAO takes over")
+					}
+				}
+			},
+			validateOperator: func(ts *testing.T, status *operatorv1.OperatorStatus) {
+				condition := v1helpers.FindOperatorCondition(status.Conditions, handedOffToCAOCondition)
+				if condition == nil || condition.Status != operatorv1.ConditionTrue {
+					ts.Errorf("expected %s=True on the operator status", handedOffToCAOCondition)
+				}
+			},
+		},
+		{
+			name: "test case 6 - no-op once fully handed off to CAO",
+			initialSecrets: []*corev1.Secret{
+				defaultSecret(fmt.Sprintf("%s-openshift-apiserver", encryptionconfig.EncryptionConfSecretName)),
+				func() *corev1.Secret {
+					s := defaultSecret(fmt.Sprintf("%s-oauth-apiserver", encryptionconfig.EncryptionConfSecretName))
+					delete(s.Annotations, EncryptionConfigManagedBy)
+					s.Finalizers = nil
+					return s
+				}(),
+			},
+			authOperator: managingOAuthAPIServerAuthOperator(),
+			validateOperator: func(ts *testing.T, status *operatorv1.OperatorStatus) {
+				condition := v1helpers.FindOperatorCondition(status.Conditions, handedOffToCAOCondition)
+				if condition == nil || condition.Status != operatorv1.ConditionTrue {
+					ts.Errorf("expected %s=True on the operator status", handedOffToCAOCondition)
+				}
+			},
+		},
+		{
+			name: "test case 7 - resumes mirroring once CAO stops managing the OAuth API server",
+			initialSecrets: []*corev1.Secret{
+				func() *corev1.Secret {
+					s := defaultSecret(fmt.Sprintf("%s-openshift-apiserver", encryptionconfig.EncryptionConfSecretName))
+					s.Data["encryption-config"] = []byte{0xAA}
+					return s
+				}(),
+				func() *corev1.Secret {
+					s := defaultSecret(fmt.Sprintf("%s-oauth-apiserver", encryptionconfig.EncryptionConfSecretName))
+					delete(s.Annotations, EncryptionConfigManagedBy)
+					s.Finalizers = nil
+					return s
+				}(),
+			},
+			expectedActions: []string{"update:secrets:openshift-config-managed:encryption-config-oauth-apiserver"},
+			expectedEvents:  []string{"SecretUpdated:oauth-apiserver"},
+		},
+		{
+			name: "test case 8 - retries on a resourceVersion conflict using the lister's refreshed copy",
+			initialSecrets: []*corev1.Secret{
+				func() *corev1.Secret {
+					s := defaultSecret(fmt.Sprintf("%s-openshift-apiserver", encryptionconfig.EncryptionConfSecretName))
+					s.Data["encryption-config"] = []byte{0xAA}
+					return s
+				}(),
+				func() *corev1.Secret {
+					s := defaultSecret(fmt.Sprintf("%s-oauth-apiserver", encryptionconfig.EncryptionConfSecretName))
+					s.ResourceVersion = "1"
+					return s
+				}(),
+			},
+			conflictOnFirstUpdate: true,
+			expectedActions: []string{
+				"update:secrets:openshift-config-managed:encryption-config-oauth-apiserver",
+				"update:secrets:openshift-config-managed:encryption-config-oauth-apiserver",
+			},
+			expectedEvents: []string{"SecretUpdated:oauth-apiserver"},
+		},
+		{
+			name: "test case 9 - preserves annotations and labels added by a third party",
+			initialSecrets: []*corev1.Secret{
+				func() *corev1.Secret {
+					s := defaultSecret(fmt.Sprintf("%s-openshift-apiserver", encryptionconfig.EncryptionConfSecretName))
+					s.Data["encryption-config"] = []byte{0xAA}
+					return s
+				}(),
+				func() *corev1.Secret {
+					s := defaultSecret(fmt.Sprintf("%s-oauth-apiserver", encryptionconfig.EncryptionConfSecretName))
+					s.Annotations["example.com/foo"] = "bar"
+					s.Labels = map[string]string{"example.com/team": "auth"}
+					return s
+				}(),
+			},
+			expectedActions: []string{"update:secrets:openshift-config-managed:encryption-config-oauth-apiserver"},
+			expectedEvents:  []string{"SecretUpdated:oauth-apiserver"},
+			validateFunc: func(ts *testing.T, actions []clientgotesting.Action) {
+				for _, action := range actions {
+					if !action.Matches("update", "secrets") {
+						continue
+					}
+					updateAction := action.(clientgotesting.UpdateAction)
+					actualSecret := updateAction.GetObject().(*corev1.Secret)
+					if actualSecret.Annotations["example.com/foo"] != "bar" {
+						ts.Errorf("expected the third-party annotation to survive reconciliation")
+					}
+					if actualSecret.Labels["example.com/team"] != "auth" {
+						ts.Errorf("expected the third-party label to survive reconciliation")
+					}
+				}
+			},
+		},
+		{
+			name: "test case 9b - re-claims a secret whose hash matches but our ownership markers were stripped",
+			initialSecrets: []*corev1.Secret{
+				defaultSecret(fmt.Sprintf("%s-openshift-apiserver", encryptionconfig.EncryptionConfSecretName)),
+				func() *corev1.Secret {
+					s := defaultSecret(fmt.Sprintf("%s-oauth-apiserver", encryptionconfig.EncryptionConfSecretName))
+					delete(s.Annotations, EncryptionConfigManagedBy)
+					s.Finalizers = nil
+					return s
+				}(),
+			},
+			expectedActions: []string{"update:secrets:openshift-config-managed:encryption-config-oauth-apiserver"},
+			expectedEvents:  []string{"SecretUpdated:oauth-apiserver"},
+			validateFunc: func(ts *testing.T, actions []clientgotesting.Action) {
+				for _, action := range actions {
+					if !action.Matches("update", "secrets") {
+						continue
+					}
+					updateAction := action.(clientgotesting.UpdateAction)
+					actualSecret := updateAction.GetObject().(*corev1.Secret)
+					if actualSecret.Annotations[EncryptionConfigManagedBy] != encryptionConfigManagedByValue {
+						ts.Errorf("expected the %s annotation to be restored", EncryptionConfigManagedBy)
+					}
+					if !hasFinalizer(actualSecret, encryptionsecret.EncryptionSecretFinalizer) {
+						ts.Errorf("expected our finalizer to be restored")
+					}
+				}
+			},
+		},
+		{
+			name: "test case 9c - a create race with another writer falls through to update",
+			initialSecrets: []*corev1.Secret{
+				defaultSecret(fmt.Sprintf("%s-openshift-apiserver", encryptionconfig.EncryptionConfSecretName)),
+			},
+			apiServerOnlySecrets: []*corev1.Secret{
+				func() *corev1.Secret {
+					s := defaultSecret(fmt.Sprintf("%s-oauth-apiserver", encryptionconfig.EncryptionConfSecretName))
+					s.Data["encryption-config"] = []byte{0xAA}
+					delete(s.Annotations, sourceHashAnnotation)
+					return s
+				}(),
+			},
+			expectedActions: []string{
+				"create:secrets:openshift-config-managed:encryption-config-oauth-apiserver",
+				"get:secrets:openshift-config-managed:encryption-config-oauth-apiserver",
+				"update:secrets:openshift-config-managed:encryption-config-oauth-apiserver",
+			},
+			expectedEvents: []string{"SecretUpdated:oauth-apiserver"},
+			validateFunc: func(ts *testing.T, actions []clientgotesting.Action) {
+				for _, action := range actions {
+					if !action.Matches("update", "secrets") {
+						continue
+					}
+					updateAction := action.(clientgotesting.UpdateAction)
+					actualSecret := updateAction.GetObject().(*corev1.Secret)
+					expectedSecret := defaultSecret(fmt.Sprintf("%s-oauth-apiserver", encryptionconfig.EncryptionConfSecretName))
+					if !equality.Semantic.DeepEqual(actualSecret, expectedSecret) {
+						ts.Errorf(diff.ObjectDiff(actualSecret, expectedSecret))
+					}
+				}
+			},
+		},
+		{
+			name: "test case 10 - a two-target matrix mirrors each target independently",
+			targets: []MirrorTarget{
+				OAuthAPIServerMirrorTarget(),
+				secondMirrorTarget(),
+			},
+			initialSecrets: []*corev1.Secret{
+				defaultSecret(fmt.Sprintf("%s-openshift-apiserver", encryptionconfig.EncryptionConfSecretName)),
+				defaultSecret(fmt.Sprintf("%s-second-apiserver", encryptionconfig.EncryptionConfSecretName)),
+			},
+			expectedActions: []string{
+				"create:secrets:openshift-config-managed:encryption-config-oauth-apiserver",
+				"create:secrets:openshift-config-managed:encryption-config-second-apiserver-mirror",
+			},
+			expectedEvents: []string{"SecretCreated:oauth-apiserver", "SecretCreated:second-apiserver"},
+		},
+		{
+			name: "test case 11 - a failure mirroring one target doesn't block the other",
+			targets: []MirrorTarget{
+				OAuthAPIServerMirrorTarget(),
+				secondMirrorTarget(),
+			},
+			initialSecrets: []*corev1.Secret{
+				defaultSecret(fmt.Sprintf("%s-openshift-apiserver", encryptionconfig.EncryptionConfSecretName)),
+				defaultSecret(fmt.Sprintf("%s-second-apiserver", encryptionconfig.EncryptionConfSecretName)),
+			},
+			failCreateForSecret: fmt.Sprintf("%s-second-apiserver-mirror", encryptionconfig.EncryptionConfSecretName),
+			expectedActions: []string{
+				"create:secrets:openshift-config-managed:encryption-config-oauth-apiserver",
+				"create:secrets:openshift-config-managed:encryption-config-second-apiserver-mirror",
+			},
+			expectedEvents: []string{"SecretCreated:oauth-apiserver"},
+			expectError:    "second-apiserver",
+		},
+		{
+			name: "test case 12 - CAO hand-off only yields the oauth-apiserver target, not an unrelated one",
+			targets: []MirrorTarget{
+				OAuthAPIServerMirrorTarget(),
+				secondMirrorTarget(),
+			},
+			initialSecrets: []*corev1.Secret{
+				defaultSecret(fmt.Sprintf("%s-openshift-apiserver", encryptionconfig.EncryptionConfSecretName)),
+				func() *corev1.Secret {
+					s := defaultSecret(fmt.Sprintf("%s-oauth-apiserver", encryptionconfig.EncryptionConfSecretName))
+					s.Annotations["encryption.apiserver.operator.openshift.io/managed-by"] = encryptionConfigManagedByValue
+					return s
+				}(),
+				func() *corev1.Secret {
+					s := defaultSecret(fmt.Sprintf("%s-second-apiserver", encryptionconfig.EncryptionConfSecretName))
+					s.Data["encryption-config"] = []byte{0xAA}
+					return s
+				}(),
+				func() *corev1.Secret {
+					s := defaultSecret(fmt.Sprintf("%s-second-apiserver-mirror", encryptionconfig.EncryptionConfSecretName))
+					s.Annotations[EncryptionConfigManagedBy] = "second-apiserver-operator"
+					return s
+				}(),
+			},
+			authOperator: managingOAuthAPIServerAuthOperator(),
+			expectedActions: []string{
+				"update:secrets:openshift-config-managed:encryption-config-oauth-apiserver",
+				"update:secrets:openshift-config-managed:encryption-config-second-apiserver-mirror",
+			},
+			expectedEvents: []string{"SecretHandedOffToCAO:oauth-apiserver", "SecretUpdated:second-apiserver"},
+			validateFunc: func(ts *testing.T, actions []clientgotesting.Action) {
+				for _, action := range actions {
+					if !action.Matches("update", "secrets") {
+						continue
+					}
+					updateAction := action.(clientgotesting.UpdateAction)
+					actualSecret := updateAction.GetObject().(*corev1.Secret)
+					switch actualSecret.Name {
+					case fmt.Sprintf("%s-oauth-apiserver", encryptionconfig.EncryptionConfSecretName):
+						if _, ok := actualSecret.Annotations[EncryptionConfigManagedBy]; ok {
+							ts.Errorf("expected the %s annotation to be removed from the oauth-apiserver target once CAO takes over", EncryptionConfigManagedBy)
+						}
+						if hasFinalizer(actualSecret, encryptionsecret.EncryptionSecretFinalizer) {
+							ts.Errorf("expected our finalizer to be removed from the oauth-apiserver target once CAO takes over")
+						}
+					case fmt.Sprintf("%s-second-apiserver-mirror", encryptionconfig.EncryptionConfSecretName):
+						if actualSecret.Annotations[EncryptionConfigManagedBy] != "second-apiserver-operator" {
+							ts.Errorf("expected the second-apiserver target to keep being mirrored, unaffected by the OAuth API server hand-off")
+						}
+					}
+				}
+			},
+		},
 	}
 
 	for _, scenario := range scenarios {
@@ -135,17 +436,58 @@ func TestOAuthAPIServerController(t *testing.T) {
 			for _, secret := range scenario.initialSecrets {
 				rawSecrets = append(rawSecrets, secret)
 			}
+			for _, secret := range scenario.apiServerOnlySecrets {
+				rawSecrets = append(rawSecrets, secret)
+			}
 			fakeKubeClient := fake.NewSimpleClientset(rawSecrets...)
+			if scenario.conflictOnFirstUpdate {
+				conflicted := false
+				fakeKubeClient.PrependReactor("update", "secrets", func(action clientgotesting.Action) (bool, runtime.Object, error) {
+					if conflicted {
+						return false, nil, nil
+					}
+					conflicted = true
+					return true, nil, apierrors.NewConflict(schema.GroupResource{Resource: "secrets"}, "encryption-config-oauth-apiserver", fmt.Errorf("stale resourceVersion"))
+				})
+			}
+			if len(scenario.failCreateForSecret) > 0 {
+				fakeKubeClient.PrependReactor("create", "secrets", func(action clientgotesting.Action) (bool, runtime.Object, error) {
+					createAction := action.(clientgotesting.CreateAction)
+					if createAction.GetObject().(*corev1.Secret).Name != scenario.failCreateForSecret {
+						return false, nil, nil
+					}
+					return true, nil, fmt.Errorf("backend unavailable")
+				})
+			}
+
+			fakeAuthOperatorIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+			if scenario.authOperator != nil {
+				fakeAuthOperatorIndexer.Add(scenario.authOperator)
+			}
+			fakeAuthOperatorLister := operatorv1listers.NewAuthenticationLister(fakeAuthOperatorIndexer)
+
+			fakeOperatorClient := v1helpers.NewFakeOperatorClient(&operatorv1.OperatorSpec{}, &operatorv1.OperatorStatus{}, nil)
+
+			targets := scenario.targets
+			if targets == nil {
+				targets = []MirrorTarget{OAuthAPIServerMirrorTarget()}
+			}
 
 			target := oauthEncryptionConfigSyncController{
-				oauthAPIServerTargetNamespace: "oauth-apiserver",
-				secretLister:                  fakeSecretsLister.Secrets(operatorclient.GlobalMachineSpecifiedConfigNamespace),
-				secretClient:                  fakeKubeClient.CoreV1().Secrets(operatorclient.GlobalMachineSpecifiedConfigNamespace),
+				targets:            targets,
+				operatorClient:     fakeOperatorClient,
+				authOperatorLister: fakeAuthOperatorLister,
+				secretLister:       fakeSecretsLister,
+				secretClient:       fakeKubeClient.CoreV1(),
 			}
 
 			// act
 			err := target.sync(context.TODO(), syncContext)
-			if err != nil {
+			if len(scenario.expectError) > 0 {
+				if err == nil || !strings.Contains(err.Error(), scenario.expectError) {
+					t.Fatalf("expected an error containing %q, got %v", scenario.expectError, err)
+				}
+			} else if err != nil {
 				t.Fatal(err)
 			}
 
@@ -160,12 +502,19 @@ func TestOAuthAPIServerController(t *testing.T) {
 			if scenario.validateFunc != nil {
 				scenario.validateFunc(t, fakeKubeClient.Actions())
 			}
+			if scenario.validateOperator != nil {
+				_, status, _, err := fakeOperatorClient.GetOperatorState()
+				if err != nil {
+					t.Fatal(err)
+				}
+				scenario.validateOperator(t, status)
+			}
 		})
 	}
 }
 
 func defaultSecret(name string) *corev1.Secret {
-	return &corev1.Secret{
+	s := &corev1.Secret{
 		ObjectMeta: v1.ObjectMeta{
 			Name:      name,
 			Namespace: operatorclient.GlobalMachineSpecifiedConfigNamespace,
@@ -177,6 +526,24 @@ func defaultSecret(name string) *corev1.Secret {
 		},
 		Data: map[string][]byte{"encryption-config": {0xFF}},
 	}
+	s.Annotations[sourceHashAnnotation] = computeSourceHash(s)
+	return s
+}
+
+func managingOAuthAPIServerAuthOperator() *operatorv1.Authentication {
+	return &operatorv1.Authentication{
+		ObjectMeta: v1.ObjectMeta{Name: authOperatorName},
+		Status: operatorv1.AuthenticationStatus{
+			OperatorStatus: operatorv1.OperatorStatus{
+				Conditions: []operatorv1.OperatorCondition{
+					{
+						Type:   managingOAuthAPIServerCondition,
+						Status: operatorv1.ConditionTrue,
+					},
+				},
+			},
+		},
+	}
 }
 
 func validateActionsVerbs(actualActions []clientgotesting.Action, expectedActions []string) error {
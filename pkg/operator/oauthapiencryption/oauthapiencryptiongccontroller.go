@@ -0,0 +1,272 @@
+package oauthapiencryption
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	multierror "github.com/hashicorp/go-multierror"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1informers "k8s.io/client-go/informers/core/v1"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/utils/clock"
+
+	configv1 "github.com/openshift/api/config/v1"
+	configv1informers "github.com/openshift/client-go/config/informers/externalversions/config/v1"
+	configv1listers "github.com/openshift/client-go/config/listers/config/v1"
+	"github.com/openshift/library-go/pkg/controller/factory"
+	encryptionsecret "github.com/openshift/library-go/pkg/operator/encryption/secrets"
+	"github.com/openshift/library-go/pkg/operator/events"
+
+	"github.com/openshift/cluster-openshift-apiserver-operator/pkg/operator/operatorclient"
+)
+
+const (
+	// defaultGarbageCollectionResync is how often we look for orphaned mirrored secrets in the
+	// absence of any triggering event.
+	defaultGarbageCollectionResync = 10 * time.Minute
+
+	// defaultManagedSecretTTL is how long a mirrored secret is allowed to keep drifting from its
+	// source before we consider it orphaned and delete it.
+	defaultManagedSecretTTL = 24 * time.Hour
+
+	apiServerClusterName = "cluster"
+
+	// driftDetectedAtAnnotation records, in RFC3339, the first time we observed the mirrored
+	// secret's content diverge from its source. The managedSecretTTL is measured from this
+	// timestamp rather than the secret's creation time, since the secret is created once and then
+	// updated in place for as long as the sync controller is keeping it current: gating on
+	// CreationTimestamp would give every drifted secret a TTL of effectively zero.
+	driftDetectedAtAnnotation = "encryption.apiserver.operator.openshift.io/drift-detected-at"
+)
+
+// oauthAPIServerSecretGarbageCollectorController deletes a mirrored encryption-config secret, for
+// each configured MirrorTarget, once it's no longer needed: the source secret is gone, encryption
+// has been switched off, or the mirror has drifted from its source and outlived its TTL. Modeled
+// after Pinniped's supervisorstorage garbage collector.
+type oauthAPIServerSecretGarbageCollectorController struct {
+	targets          []MirrorTarget
+	managedSecretTTL time.Duration
+	clock            clock.Clock
+
+	secretLister    corev1listers.SecretLister
+	secretClient    corev1client.SecretsGetter
+	apiServerLister configv1listers.APIServerLister
+}
+
+// NewOAuthAPIServerSecretGarbageCollectorController returns a controller that garbage collects the
+// mirrored secret of every given target once it is orphaned.
+func NewOAuthAPIServerSecretGarbageCollectorController(
+	targets []MirrorTarget,
+	secretInformer corev1informers.SecretInformer,
+	secretClient corev1client.SecretsGetter,
+	apiServerInformer configv1informers.APIServerInformer,
+	recorder events.Recorder,
+) factory.Controller {
+	return newOAuthAPIServerSecretGarbageCollectorController(
+		targets,
+		defaultManagedSecretTTL,
+		clock.RealClock{},
+		secretInformer,
+		secretClient,
+		apiServerInformer,
+		recorder,
+	)
+}
+
+// newOAuthAPIServerSecretGarbageCollectorController takes an explicit TTL and clock so tests don't
+// have to wait on wall-clock time.
+func newOAuthAPIServerSecretGarbageCollectorController(
+	targets []MirrorTarget,
+	managedSecretTTL time.Duration,
+	gcClock clock.Clock,
+	secretInformer corev1informers.SecretInformer,
+	secretClient corev1client.SecretsGetter,
+	apiServerInformer configv1informers.APIServerInformer,
+	recorder events.Recorder,
+) factory.Controller {
+	c := &oauthAPIServerSecretGarbageCollectorController{
+		targets:          targets,
+		managedSecretTTL: managedSecretTTL,
+		clock:            gcClock,
+		secretLister:     secretInformer.Lister(),
+		secretClient:     secretClient,
+		apiServerLister:  apiServerInformer.Lister(),
+	}
+
+	return factory.New().
+		WithSync(c.sync).
+		ResyncEvery(defaultGarbageCollectionResync).
+		WithInformers(secretInformer.Informer(), apiServerInformer.Informer()).
+		ToController("OAuthAPIServerSecretGarbageCollectorController", recorder)
+}
+
+func (c *oauthAPIServerSecretGarbageCollectorController) sync(ctx context.Context, syncCtx factory.SyncContext) error {
+	var errs *multierror.Error
+	for _, target := range c.targets {
+		if err := c.syncTarget(ctx, syncCtx, target); err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("garbage collecting %q: %w", target.Name, err))
+		}
+	}
+	return errs.ErrorOrNil()
+}
+
+func (c *oauthAPIServerSecretGarbageCollectorController) syncTarget(ctx context.Context, syncCtx factory.SyncContext, target MirrorTarget) error {
+	dest, err := c.secretLister.Secrets(target.DestNamespace).Get(target.DestSecretName)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if dest.Annotations[EncryptionConfigManagedBy] != target.ManagedByValue {
+		// someone else owns this secret, never touch it
+		return nil
+	}
+
+	reason, shouldDelete, err := c.shouldGarbageCollect(ctx, target, dest)
+	if err != nil {
+		return err
+	}
+	if !shouldDelete {
+		return nil
+	}
+
+	if err := c.deleteSecret(ctx, target, dest); err != nil {
+		return err
+	}
+	syncCtx.Recorder().Eventf(fmt.Sprintf("SecretGarbageCollected:%s", target.Name), "Deleted orphaned secret %s/%s: %s", target.DestNamespace, target.DestSecretName, reason)
+	return nil
+}
+
+func (c *oauthAPIServerSecretGarbageCollectorController) shouldGarbageCollect(ctx context.Context, target MirrorTarget, dest *corev1.Secret) (string, bool, error) {
+	source, err := c.secretLister.Secrets(operatorclient.GlobalMachineSpecifiedConfigNamespace).Get(target.SourceSecretName)
+	if apierrors.IsNotFound(err) {
+		return "the source secret no longer exists", true, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+
+	// Encryption.Type on the cluster-scoped APIServer resource is a single switch shared by every
+	// aggregated API server this operator mirrors encryption-config for, so it's deliberately
+	// checked the same way for every target rather than being looked up per target.
+	apiServer, err := c.apiServerLister.Get(apiServerClusterName)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return "", false, err
+	}
+	if err == nil && encryptionIsOff(apiServer) {
+		return "encryption has been turned off", true, nil
+	}
+
+	if bytes.Equal(dest.Data["encryption-config"], source.Data["encryption-config"]) {
+		if _, drifted := dest.Annotations[driftDetectedAtAnnotation]; drifted {
+			return "", false, c.clearDriftDetected(ctx, target, dest)
+		}
+		return "", false, nil
+	}
+
+	driftDetectedAt, ok := dest.Annotations[driftDetectedAtAnnotation]
+	if !ok {
+		// first time we've seen this secret drift: stamp when, and only consider it orphaned once
+		// the TTL has elapsed since this moment, not since the secret's creation.
+		return "", false, c.markDriftDetected(ctx, target, dest)
+	}
+
+	observedAt, err := time.Parse(time.RFC3339, driftDetectedAt)
+	if err != nil {
+		// malformed annotation, most likely from an older version of this controller: treat it as
+		// freshly observed rather than failing sync.
+		return "", false, c.markDriftDetected(ctx, target, dest)
+	}
+
+	if c.clock.Since(observedAt) > c.managedSecretTTL {
+		return "the secret no longer matches any live source and has outlived its TTL", true, nil
+	}
+
+	return "", false, nil
+}
+
+// markDriftDetected stamps dest with the current time so a later sync can tell how long this
+// secret has been mismatched with its source.
+func (c *oauthAPIServerSecretGarbageCollectorController) markDriftDetected(ctx context.Context, target MirrorTarget, dest *corev1.Secret) error {
+	return c.updateWithConflictRetry(ctx, target, dest, func(secret *corev1.Secret) {
+		if secret.Annotations == nil {
+			secret.Annotations = map[string]string{}
+		}
+		secret.Annotations[driftDetectedAtAnnotation] = c.clock.Now().UTC().Format(time.RFC3339)
+	})
+}
+
+// clearDriftDetected removes the drift-observed annotation once dest matches its source again, so
+// a later, unrelated drift starts its own TTL from scratch.
+func (c *oauthAPIServerSecretGarbageCollectorController) clearDriftDetected(ctx context.Context, target MirrorTarget, dest *corev1.Secret) error {
+	return c.updateWithConflictRetry(ctx, target, dest, func(secret *corev1.Secret) {
+		delete(secret.Annotations, driftDetectedAtAnnotation)
+	})
+}
+
+// updateWithConflictRetry applies mutate on top of existing and persists it, retrying on a
+// resourceVersion conflict by re-fetching via the lister, the same way the sync controller's
+// updateMirror survives races with other writers of the destination secret.
+func (c *oauthAPIServerSecretGarbageCollectorController) updateWithConflictRetry(ctx context.Context, target MirrorTarget, existing *corev1.Secret, mutate func(*corev1.Secret)) error {
+	current := existing
+	for attempt := 0; attempt < maxUpdateConflictRetries; attempt++ {
+		desired := current.DeepCopy()
+		mutate(desired)
+
+		_, err := c.secretClient.Secrets(target.DestNamespace).Update(ctx, desired, metav1.UpdateOptions{})
+		if err == nil {
+			return nil
+		}
+		if !apierrors.IsConflict(err) {
+			return err
+		}
+
+		refetched, err := c.secretLister.Secrets(target.DestNamespace).Get(existing.Name)
+		if err != nil {
+			return err
+		}
+		current = refetched
+	}
+
+	return fmt.Errorf("failed to update secret %s/%s after %d conflict retries", target.DestNamespace, existing.Name, maxUpdateConflictRetries)
+}
+
+func (c *oauthAPIServerSecretGarbageCollectorController) deleteSecret(ctx context.Context, target MirrorTarget, secret *corev1.Secret) error {
+	if hasFinalizer(secret, encryptionsecret.EncryptionSecretFinalizer) {
+		updated := secret.DeepCopy()
+		updated.Finalizers = removeFinalizer(updated.Finalizers, encryptionsecret.EncryptionSecretFinalizer)
+		persisted, err := c.secretClient.Secrets(target.DestNamespace).Update(ctx, updated, metav1.UpdateOptions{})
+		if err != nil {
+			return err
+		}
+		secret = persisted
+	}
+
+	foreground := metav1.DeletePropagationForeground
+	err := c.secretClient.Secrets(target.DestNamespace).Delete(ctx, secret.Name, metav1.DeleteOptions{
+		Preconditions:     &metav1.Preconditions{UID: &secret.UID, ResourceVersion: &secret.ResourceVersion},
+		PropagationPolicy: &foreground,
+	})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// encryptionIsOff reports whether the openshift-apiserver's encryption has been switched off, in
+// which case there is no longer a reason to keep a mirrored encryption-config around.
+func encryptionIsOff(apiServer *configv1.APIServer) bool {
+	switch apiServer.Spec.Encryption.Type {
+	case "", configv1.EncryptionTypeIdentity:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,264 @@
+package oauthapiencryption
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+	clientgotesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+	clocktesting "k8s.io/utils/clock/testing"
+
+	configv1 "github.com/openshift/api/config/v1"
+	configv1listers "github.com/openshift/client-go/config/listers/config/v1"
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/encryption/encryptionconfig"
+	"github.com/openshift/library-go/pkg/operator/events"
+)
+
+func TestOAuthAPIServerSecretGarbageCollectorController(t *testing.T) {
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	scenarios := []struct {
+		name            string
+		targets         []MirrorTarget
+		initialSecrets  []*corev1.Secret
+		apiServer       *configv1.APIServer
+		expectedActions []string
+		expectedEvents  []string
+		validateFunc    func(ts *testing.T, actions []clientgotesting.Action)
+	}{
+		{
+			name: "no-op when the mirrored secret doesn't exist",
+		},
+		{
+			name: "no-op when the mirrored secret isn't managed by us",
+			initialSecrets: []*corev1.Secret{
+				func() *corev1.Secret {
+					s := defaultSecret(fmt.Sprintf("%s-oauth-apiserver", encryptionconfig.EncryptionConfSecretName))
+					delete(s.Annotations, EncryptionConfigManagedBy)
+					s.Finalizers = nil
+					return s
+				}(),
+			},
+		},
+		{
+			name: "no-op when the source secret still exists, encryption is on and the mirror is up to date",
+			initialSecrets: []*corev1.Secret{
+				defaultSecret(fmt.Sprintf("%s-openshift-apiserver", encryptionconfig.EncryptionConfSecretName)),
+				defaultSecret(fmt.Sprintf("%s-oauth-apiserver", encryptionconfig.EncryptionConfSecretName)),
+			},
+			apiServer: apiServerWithEncryption(configv1.EncryptionTypeAESCBC),
+		},
+		{
+			name: "deletes the mirror when the source secret no longer exists",
+			initialSecrets: []*corev1.Secret{
+				defaultSecret(fmt.Sprintf("%s-oauth-apiserver", encryptionconfig.EncryptionConfSecretName)),
+			},
+			expectedActions: []string{
+				"update:secrets:openshift-config-managed:encryption-config-oauth-apiserver",
+				"delete:secrets:openshift-config-managed:encryption-config-oauth-apiserver",
+			},
+			expectedEvents: []string{"SecretGarbageCollected:oauth-apiserver"},
+		},
+		{
+			name: "deletes the mirror when encryption has been turned off",
+			initialSecrets: []*corev1.Secret{
+				defaultSecret(fmt.Sprintf("%s-openshift-apiserver", encryptionconfig.EncryptionConfSecretName)),
+				defaultSecret(fmt.Sprintf("%s-oauth-apiserver", encryptionconfig.EncryptionConfSecretName)),
+			},
+			apiServer: apiServerWithEncryption(configv1.EncryptionTypeIdentity),
+			expectedActions: []string{
+				"update:secrets:openshift-config-managed:encryption-config-oauth-apiserver",
+				"delete:secrets:openshift-config-managed:encryption-config-oauth-apiserver",
+			},
+			expectedEvents: []string{"SecretGarbageCollected:oauth-apiserver"},
+		},
+		{
+			name: "stamps the drift-detected-at annotation the first time a mismatch is observed, without deleting",
+			initialSecrets: []*corev1.Secret{
+				func() *corev1.Secret {
+					s := defaultSecret(fmt.Sprintf("%s-openshift-apiserver", encryptionconfig.EncryptionConfSecretName))
+					s.Data["encryption-config"] = []byte{0xAA}
+					return s
+				}(),
+				func() *corev1.Secret {
+					s := defaultSecret(fmt.Sprintf("%s-oauth-apiserver", encryptionconfig.EncryptionConfSecretName))
+					s.CreationTimestamp = v1.NewTime(now.Add(-48 * time.Hour))
+					return s
+				}(),
+			},
+			apiServer: apiServerWithEncryption(configv1.EncryptionTypeAESCBC),
+			expectedActions: []string{
+				"update:secrets:openshift-config-managed:encryption-config-oauth-apiserver",
+			},
+			validateFunc: func(ts *testing.T, actions []clientgotesting.Action) {
+				for _, action := range actions {
+					if !action.Matches("update", "secrets") {
+						continue
+					}
+					updateAction := action.(clientgotesting.UpdateAction)
+					actualSecret := updateAction.GetObject().(*corev1.Secret)
+					if actualSecret.Annotations[driftDetectedAtAnnotation] != now.Format(time.RFC3339) {
+						ts.Errorf("expected %s to be stamped with %s, got %q", driftDetectedAtAnnotation, now.Format(time.RFC3339), actualSecret.Annotations[driftDetectedAtAnnotation])
+					}
+				}
+			},
+		},
+		{
+			name: "clears the drift-detected-at annotation once the mirror matches its source again",
+			initialSecrets: []*corev1.Secret{
+				defaultSecret(fmt.Sprintf("%s-openshift-apiserver", encryptionconfig.EncryptionConfSecretName)),
+				func() *corev1.Secret {
+					s := defaultSecret(fmt.Sprintf("%s-oauth-apiserver", encryptionconfig.EncryptionConfSecretName))
+					s.Annotations[driftDetectedAtAnnotation] = now.Add(-time.Hour).Format(time.RFC3339)
+					return s
+				}(),
+			},
+			apiServer: apiServerWithEncryption(configv1.EncryptionTypeAESCBC),
+			expectedActions: []string{
+				"update:secrets:openshift-config-managed:encryption-config-oauth-apiserver",
+			},
+			validateFunc: func(ts *testing.T, actions []clientgotesting.Action) {
+				for _, action := range actions {
+					if !action.Matches("update", "secrets") {
+						continue
+					}
+					updateAction := action.(clientgotesting.UpdateAction)
+					actualSecret := updateAction.GetObject().(*corev1.Secret)
+					if _, ok := actualSecret.Annotations[driftDetectedAtAnnotation]; ok {
+						ts.Errorf("expected %s to be cleared once the mirror matches its source again", driftDetectedAtAnnotation)
+					}
+				}
+			},
+		},
+		{
+			name: "no-op when the mirror has drifted from its source but hasn't outlived its TTL",
+			initialSecrets: []*corev1.Secret{
+				func() *corev1.Secret {
+					s := defaultSecret(fmt.Sprintf("%s-openshift-apiserver", encryptionconfig.EncryptionConfSecretName))
+					s.Data["encryption-config"] = []byte{0xAA}
+					return s
+				}(),
+				func() *corev1.Secret {
+					s := defaultSecret(fmt.Sprintf("%s-oauth-apiserver", encryptionconfig.EncryptionConfSecretName))
+					s.Annotations[driftDetectedAtAnnotation] = now.Add(-time.Hour).Format(time.RFC3339)
+					return s
+				}(),
+			},
+			apiServer: apiServerWithEncryption(configv1.EncryptionTypeAESCBC),
+		},
+		{
+			name: "deletes the mirror once it has drifted from its source and outlived its TTL",
+			initialSecrets: []*corev1.Secret{
+				func() *corev1.Secret {
+					s := defaultSecret(fmt.Sprintf("%s-openshift-apiserver", encryptionconfig.EncryptionConfSecretName))
+					s.Data["encryption-config"] = []byte{0xAA}
+					return s
+				}(),
+				func() *corev1.Secret {
+					s := defaultSecret(fmt.Sprintf("%s-oauth-apiserver", encryptionconfig.EncryptionConfSecretName))
+					s.Annotations[driftDetectedAtAnnotation] = now.Add(-48 * time.Hour).Format(time.RFC3339)
+					return s
+				}(),
+			},
+			apiServer: apiServerWithEncryption(configv1.EncryptionTypeAESCBC),
+			expectedActions: []string{
+				"update:secrets:openshift-config-managed:encryption-config-oauth-apiserver",
+				"delete:secrets:openshift-config-managed:encryption-config-oauth-apiserver",
+			},
+			expectedEvents: []string{"SecretGarbageCollected:oauth-apiserver"},
+		},
+		{
+			name: "a two-target matrix garbage collects each target independently",
+			targets: []MirrorTarget{
+				OAuthAPIServerMirrorTarget(),
+				secondMirrorTarget(),
+			},
+			initialSecrets: []*corev1.Secret{
+				defaultSecret(fmt.Sprintf("%s-oauth-apiserver", encryptionconfig.EncryptionConfSecretName)),
+				func() *corev1.Secret {
+					s := defaultSecret(fmt.Sprintf("%s-second-apiserver-mirror", encryptionconfig.EncryptionConfSecretName))
+					s.Annotations[EncryptionConfigManagedBy] = "second-apiserver-operator"
+					return s
+				}(),
+			},
+			expectedActions: []string{
+				"update:secrets:openshift-config-managed:encryption-config-oauth-apiserver",
+				"delete:secrets:openshift-config-managed:encryption-config-oauth-apiserver",
+				"update:secrets:openshift-config-managed:encryption-config-second-apiserver-mirror",
+				"delete:secrets:openshift-config-managed:encryption-config-second-apiserver-mirror",
+			},
+			expectedEvents: []string{"SecretGarbageCollected:oauth-apiserver", "SecretGarbageCollected:second-apiserver"},
+		},
+	}
+
+	for _, scenario := range scenarios {
+		t.Run(scenario.name, func(t *testing.T) {
+			eventRecorder := events.NewInMemoryRecorder("")
+			syncContext := factory.NewSyncContext("", eventRecorder)
+
+			fakeSecretsIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+			for _, secret := range scenario.initialSecrets {
+				fakeSecretsIndexer.Add(secret)
+			}
+			fakeSecretsLister := corev1listers.NewSecretLister(fakeSecretsIndexer)
+
+			rawSecrets := []runtime.Object{}
+			for _, secret := range scenario.initialSecrets {
+				rawSecrets = append(rawSecrets, secret)
+			}
+			fakeKubeClient := fake.NewSimpleClientset(rawSecrets...)
+
+			fakeAPIServerIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+			if scenario.apiServer != nil {
+				fakeAPIServerIndexer.Add(scenario.apiServer)
+			}
+			fakeAPIServerLister := configv1listers.NewAPIServerLister(fakeAPIServerIndexer)
+
+			targets := scenario.targets
+			if targets == nil {
+				targets = []MirrorTarget{OAuthAPIServerMirrorTarget()}
+			}
+
+			target := oauthAPIServerSecretGarbageCollectorController{
+				targets:          targets,
+				managedSecretTTL: 24 * time.Hour,
+				clock:            clocktesting.NewFakeClock(now),
+				secretLister:     fakeSecretsLister,
+				secretClient:     fakeKubeClient.CoreV1(),
+				apiServerLister:  fakeAPIServerLister,
+			}
+
+			err := target.sync(context.TODO(), syncContext)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := validateActionsVerbs(fakeKubeClient.Actions(), scenario.expectedActions); err != nil {
+				t.Fatal(err)
+			}
+			if err := validateEventsReason(eventRecorder.Events(), scenario.expectedEvents); err != nil {
+				t.Error(err)
+			}
+			if scenario.validateFunc != nil {
+				scenario.validateFunc(t, fakeKubeClient.Actions())
+			}
+		})
+	}
+}
+
+func apiServerWithEncryption(encryptionType configv1.EncryptionType) *configv1.APIServer {
+	return &configv1.APIServer{
+		ObjectMeta: v1.ObjectMeta{Name: apiServerClusterName},
+		Spec: configv1.APIServerSpec{
+			Encryption: configv1.APIServerEncryption{Type: encryptionType},
+		},
+	}
+}